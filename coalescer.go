@@ -0,0 +1,195 @@
+package main
+
+import (
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var coalesceWindow time.Duration
+
+func init() {
+	secs := 10
+	if v, ok := os.LookupEnv("STASH_WATCH_COALESCE_SECS"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatal("invalid STASH_WATCH_COALESCE_SECS:", err)
+		}
+		secs = n
+	}
+	coalesceWindow = time.Duration(secs) * time.Second
+}
+
+// pathOp is one accepted filesystem change queued with the coalescer. id is
+// normally empty, which tells run() to mint a fresh journal entry; replay
+// paths (see addReplay) carry the ID of the journal entry that prompted the
+// replay, so the scan it's folded into acknowledges that original entry
+// instead of an orphaned new one.
+type pathOp struct {
+	path string
+	op   string
+	id   string
+}
+
+// scanCoalescer accumulates the parent directories of accepted filesystem
+// events and, after a quiet period with no new events, issues a single
+// metadataScan covering the minimal set of ancestor directories needed to
+// cover every change. This avoids firing one global scan per debounced
+// event, which is wasteful for bulk imports and moves.
+type scanCoalescer struct {
+	paths   chan pathOp
+	tracker *JobTracker
+	journal *eventJournal
+}
+
+func newScanCoalescer(tracker *JobTracker, journal *eventJournal) *scanCoalescer {
+	c := &scanCoalescer{
+		paths:   make(chan pathOp),
+		tracker: tracker,
+		journal: journal,
+	}
+
+	go c.run()
+
+	return c
+}
+
+// add registers path (or its parent directory, if path is a file) as having
+// changed. op is a short label ("create", "write", "remove", ...) recorded
+// in the event journal for diagnostics; callers that don't know the
+// original op (replay, the post-restart root walk) may pass "replay".
+// Safe to call from multiple goroutines.
+func (c *scanCoalescer) add(path, op string) {
+	c.paths <- pathOp{path: path, op: op}
+}
+
+// addReplay re-queues path using the ID of the journal entry that prompted
+// the replay, so that when the resulting scan completes it acknowledges that
+// original entry instead of the fresh one a plain add would mint.
+func (c *scanCoalescer) addReplay(path, id string) {
+	c.paths <- pathOp{path: path, op: "replay", id: id}
+}
+
+func (c *scanCoalescer) run() {
+	var (
+		mu      sync.Mutex
+		pending = make(map[string][]string) // dir -> journal entry IDs covered by it
+	)
+
+	timer := time.NewTimer(math.MaxInt64)
+	timer.Stop()
+
+	flush := func() {
+		mu.Lock()
+		if len(pending) == 0 {
+			mu.Unlock()
+			return
+		}
+		dirs := make([]string, 0, len(pending))
+		var ids []string
+		for d, dirIDs := range pending {
+			dirs = append(dirs, d)
+			ids = append(ids, dirIDs...)
+		}
+		mu.Unlock()
+
+		scoped := minimalAncestors(dirs)
+
+		if c.tracker != nil && c.tracker.Overlaps(scoped) {
+			printInfo("An overlapping scan is already running in Stash, will retry:", strings.Join(scoped, ", "))
+			// leave pending untouched (plus whatever arrived meanwhile) and
+			// try again after the next quiet period
+			timer.Reset(coalesceWindow)
+			return
+		}
+
+		mu.Lock()
+		pending = make(map[string][]string)
+		mu.Unlock()
+
+		printInfo("Coalesced scan covering", len(scoped), "path(s):", strings.Join(scoped, ", "))
+		jobID, err := sendScanRequest(endpointEnv, doAuthEnv, scoped)
+		if err != nil {
+			// leave the journal entries unacknowledged; a crash-restart
+			// replay will retry them even though this process won't
+			return
+		}
+		if c.tracker != nil {
+			c.tracker.Track(jobID, scoped, ids)
+		}
+	}
+
+	for {
+		select {
+		case pe, ok := <-c.paths:
+			if !ok {
+				return
+			}
+
+			dir := coalesceDir(pe.path)
+
+			id := pe.id
+			if id == "" {
+				id = c.journal.Record(pe.path, pe.op)
+			}
+
+			mu.Lock()
+			pending[dir] = append(pending[dir], id)
+			mu.Unlock()
+
+			timer.Reset(coalesceWindow)
+
+		case <-timer.C:
+			flush()
+		}
+	}
+}
+
+// coalesceDir returns the directory a changed path should be attributed to
+// for scanning purposes: path itself if it's still a directory, otherwise
+// its parent. A remove op's path is already gone by the time this runs, so
+// os.Stat always fails for it; that's treated the same as "it was a file",
+// since a path that no longer exists was never a directory we could scan.
+func coalesceDir(path string) string {
+	if f, err := os.Stat(path); err != nil || !f.IsDir() {
+		return filepath.Dir(path)
+	}
+	return path
+}
+
+// minimalAncestors reduces paths to the smallest subset such that every
+// original path is equal to, or a descendant of, some path in the result.
+// This keeps the metadataScan input.paths list minimal instead of asking
+// Stash to walk the same tree from several different starting points.
+func minimalAncestors(paths []string) []string {
+	clean := make([]string, len(paths))
+	for i, p := range paths {
+		clean[i] = filepath.Clean(p)
+	}
+
+	sort.Slice(clean, func(i, j int) bool {
+		return len(clean[i]) < len(clean[j])
+	})
+
+	var result []string
+	for _, p := range clean {
+		covered := false
+		for _, r := range result {
+			if p == r || strings.HasPrefix(p, r+string(filepath.Separator)) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			result = append(result, p)
+		}
+	}
+
+	return result
+}
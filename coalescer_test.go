@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestMinimalAncestors(t *testing.T) {
+	tests := []struct {
+		name  string
+		paths []string
+		want  []string
+	}{
+		{
+			name:  "empty",
+			paths: nil,
+			want:  nil,
+		},
+		{
+			name:  "single path",
+			paths: []string{"/library/movies"},
+			want:  []string{"/library/movies"},
+		},
+		{
+			name:  "descendant covered by ancestor",
+			paths: []string{"/library/movies", "/library/movies/action"},
+			want:  []string{"/library/movies"},
+		},
+		{
+			name:  "order independent",
+			paths: []string{"/library/movies/action", "/library/movies"},
+			want:  []string{"/library/movies"},
+		},
+		{
+			name:  "siblings stay separate",
+			paths: []string{"/library/movies", "/library/shows"},
+			want:  []string{"/library/movies", "/library/shows"},
+		},
+		{
+			name:  "prefix that isn't a path ancestor stays separate",
+			paths: []string{"/library/movies", "/library/movies2"},
+			want:  []string{"/library/movies", "/library/movies2"},
+		},
+		{
+			name:  "duplicate paths collapse",
+			paths: []string{"/library/movies", "/library/movies"},
+			want:  []string{"/library/movies"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := minimalAncestors(tt.paths)
+			sort.Strings(got)
+			want := append([]string(nil), tt.want...)
+			sort.Strings(want)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("minimalAncestors(%v) = %v, want %v", tt.paths, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCoalesceDir(t *testing.T) {
+	dir := t.TempDir()
+
+	file := filepath.Join(dir, "a.mp4")
+	if err := os.WriteFile(file, []byte("x"), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	removed := filepath.Join(dir, "gone.mp4")
+	if err := os.WriteFile(removed, []byte("x"), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := os.Remove(removed); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{name: "existing file resolves to its parent", path: file, want: dir},
+		{name: "existing directory resolves to itself", path: dir, want: dir},
+		{name: "removed path (remove op) resolves to its parent", path: removed, want: dir},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := coalesceDir(tt.path); got != tt.want {
+				t.Errorf("coalesceDir(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestCoalescerRemoveOpScansParentDirectory drives a remove op all the way
+// through scanCoalescer.run() and a real (fake) metadataScan request, to
+// guard against the dir-derivation bug where a removed file's own
+// now-nonexistent path was sent to Stash instead of its parent directory.
+func TestCoalescerRemoveOpScansParentDirectory(t *testing.T) {
+	dir := t.TempDir()
+	removed := filepath.Join(dir, "gone.mp4")
+	if err := os.WriteFile(removed, []byte("x"), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := os.Remove(removed); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+
+	scanned := make(chan []string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var parsed struct {
+			Variables struct {
+				Paths []string `json:"paths"`
+			} `json:"variables"`
+		}
+		json.Unmarshal(body, &parsed)
+		scanned <- parsed.Variables.Paths
+		w.Write([]byte(`{"data":{"metadataScan":"job-1"}}`))
+	}))
+	defer srv.Close()
+
+	origEndpoint := endpointEnv
+	endpointEnv = srv.URL
+	defer func() { endpointEnv = origEndpoint }()
+
+	origWindow := coalesceWindow
+	coalesceWindow = 10 * time.Millisecond
+	defer func() { coalesceWindow = origWindow }()
+
+	j := newTestJournal(t)
+	newScanCoalescer(nil, j).add(removed, "remove")
+
+	select {
+	case got := <-scanned:
+		if len(got) != 1 || got[0] != dir {
+			t.Errorf("scanned paths = %v, want [%s]", got, dir)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for a scan request")
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v4"
+	"gopkg.in/yaml.v3"
+)
+
+// stringListFlag collects repeated occurrences of a flag into a slice, the
+// same way watcher collects --watcher.
+type stringListFlag []string
+
+func (s *stringListFlag) String() string {
+	return fmt.Sprint(*s)
+}
+
+func (s *stringListFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+var (
+	includeFlag      stringListFlag
+	excludeFlag      stringListFlag
+	excludeRegexFlag stringListFlag
+	includeExtFlag   string
+	filterConfigEnv  string
+)
+
+func init() {
+	flag.Var(&includeFlag, "include", "Glob a changed path must match to trigger a scan (may be specified multiple times).")
+	flag.Var(&excludeFlag, "exclude", "Glob a changed path must NOT match to trigger a scan (may be specified multiple times).")
+	flag.Var(&excludeRegexFlag, "exclude-regex", "Regex a changed path must NOT match to trigger a scan (may be specified multiple times).")
+	flag.StringVar(&includeExtFlag, "include-ext", "", "Comma-separated list of file extensions (without the dot) that trigger a scan.")
+
+	filterConfigEnv = os.Getenv("STASH_WATCH_CONFIG")
+}
+
+// filterConfig is the shape of the optional YAML file pointed to by
+// STASH_WATCH_CONFIG. It's merged with the equivalent flags rather than
+// replacing them, since most users end up wanting dozens of rules that
+// aren't practical to pass on the command line.
+type filterConfig struct {
+	Include      []string `yaml:"include"`
+	Exclude      []string `yaml:"exclude"`
+	ExcludeRegex []string `yaml:"excludeRegex"`
+	IncludeExt   []string `yaml:"includeExt"`
+}
+
+// pathFilter decides whether a changed path should trigger a scan. Rules
+// are evaluated exclude-regex, then exclude-glob, then include-ext, then
+// include-glob; a path is rejected by the first rule it fails.
+type pathFilter struct {
+	include        []string
+	exclude        []string
+	excludeRegexes []*regexp.Regexp
+	includeExt     map[string]struct{}
+}
+
+func newPathFilter() (*pathFilter, error) {
+	cfg := filterConfig{
+		Include:      includeFlag,
+		Exclude:      excludeFlag,
+		ExcludeRegex: excludeRegexFlag,
+	}
+	if includeExtFlag != "" {
+		cfg.IncludeExt = strings.Split(includeExtFlag, ",")
+	}
+
+	if filterConfigEnv != "" {
+		fileCfg, err := loadFilterConfig(filterConfigEnv)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Include = append(cfg.Include, fileCfg.Include...)
+		cfg.Exclude = append(cfg.Exclude, fileCfg.Exclude...)
+		cfg.ExcludeRegex = append(cfg.ExcludeRegex, fileCfg.ExcludeRegex...)
+		cfg.IncludeExt = append(cfg.IncludeExt, fileCfg.IncludeExt...)
+	}
+
+	f := &pathFilter{
+		include: cfg.Include,
+		exclude: cfg.Exclude,
+	}
+
+	for _, pattern := range cfg.ExcludeRegex {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exclude-regex %q: %w", pattern, err)
+		}
+		f.excludeRegexes = append(f.excludeRegexes, re)
+	}
+
+	if len(cfg.IncludeExt) > 0 {
+		f.includeExt = make(map[string]struct{}, len(cfg.IncludeExt))
+		for _, ext := range cfg.IncludeExt {
+			ext = strings.ToLower(strings.TrimSpace(ext))
+			ext = strings.TrimPrefix(ext, ".")
+			if ext == "" {
+				continue
+			}
+			f.includeExt[ext] = struct{}{}
+		}
+	}
+
+	return f, nil
+}
+
+func loadFilterConfig(path string) (filterConfig, error) {
+	var cfg filterConfig
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("could not read filter config %q: %w", path, err)
+	}
+
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("could not parse filter config %q: %w", path, err)
+	}
+
+	return cfg, nil
+}
+
+// excluded reports whether path matches any exclude rule. This is checked
+// for both files and directories, since users also want to keep the
+// watcher out of directories like Stash's own .stash cache folder.
+func (f *pathFilter) excluded(path string) bool {
+	slashed := filepath.ToSlash(path)
+
+	for _, re := range f.excludeRegexes {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+
+	for _, pattern := range f.exclude {
+		if matched, _ := doublestar.Match(pattern, slashed); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Allow reports whether a change to path should trigger a scan. isDir
+// should be true when path is a directory: include-ext and include rules
+// only make sense for files, so they're skipped for directories (otherwise
+// an include-ext rule would stop the watcher from ever following new
+// subdirectories).
+func (f *pathFilter) Allow(path string, isDir bool) bool {
+	if f.excluded(path) {
+		return false
+	}
+
+	if isDir {
+		return true
+	}
+
+	if len(f.includeExt) > 0 {
+		ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(path), "."))
+		if _, ok := f.includeExt[ext]; !ok {
+			return false
+		}
+	}
+
+	if len(f.include) > 0 {
+		slashed := filepath.ToSlash(path)
+		for _, pattern := range f.include {
+			if matched, _ := doublestar.Match(pattern, slashed); matched {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestPathFilterAllow(t *testing.T) {
+	f := &pathFilter{
+		include:        []string{"**/*.mp4", "**/*.mkv"},
+		exclude:        []string{"**/.stash/**"},
+		excludeRegexes: []*regexp.Regexp{regexp.MustCompile(`(?i)\.(nfo|part)$`)},
+		includeExt:     map[string]struct{}{"mp4": {}, "mkv": {}},
+	}
+
+	tests := []struct {
+		name  string
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{name: "allowed extension and include glob", path: "/library/movies/a.mp4", want: true},
+		{name: "wrong extension rejected by include-ext", path: "/library/movies/poster.jpg", want: false},
+		{name: "excluded directory wins over everything else", path: "/library/.stash/cache/a.mp4", want: false},
+		{name: "exclude regex wins even for an allowed extension", path: "/library/movies/a.part", want: false},
+		{name: "directories skip include/include-ext checks", path: "/library/movies/new-folder", isDir: true, want: true},
+		{name: "excluded directory is rejected even though it's a dir", path: "/library/.stash", isDir: true, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := f.Allow(tt.path, tt.isDir); got != tt.want {
+				t.Errorf("Allow(%q, isDir=%v) = %v, want %v", tt.path, tt.isDir, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPathFilterAllowWithoutIncludeRulesDefaultsToAllow(t *testing.T) {
+	f := &pathFilter{exclude: []string{"**/*.tmp"}}
+
+	if !f.Allow("/library/movies/a.mp4", false) {
+		t.Error("expected a.mp4 to be allowed when no include rules are configured")
+	}
+	if f.Allow("/library/movies/a.tmp", false) {
+		t.Error("expected a.tmp to be rejected by the exclude glob")
+	}
+}
+
+func TestPathFilterIncludeGlobPrecedesDefaultAllow(t *testing.T) {
+	f := &pathFilter{include: []string{"**/keep/**"}}
+
+	if !f.Allow("/library/keep/a.mp4", false) {
+		t.Error("expected a path matching the include glob to be allowed")
+	}
+	if f.Allow("/library/skip/a.mp4", false) {
+		t.Error("expected a path not matching any include glob to be rejected")
+	}
+}
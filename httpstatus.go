@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+)
+
+var httpStatusAddrEnv string
+
+func init() {
+	httpStatusAddrEnv = ":8585"
+	if v, ok := os.LookupEnv("STASH_WATCH_HTTP_ADDR"); ok {
+		httpStatusAddrEnv = v
+	}
+}
+
+// statusResponse is what /status reports: the jobs the watcher currently
+// believes are in flight in Stash.
+type statusResponse struct {
+	WatchBackend string       `json:"watchBackend"`
+	InFlightJobs []trackedJob `json:"inFlightJobs"`
+}
+
+// serveStatus starts the /healthz and /status HTTP endpoints in the
+// background so users can see what the watcher is doing without digging
+// through logs.
+func serveStatus(tracker *JobTracker) {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+	})
+
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		resp := statusResponse{
+			WatchBackend: watchBackendEnv,
+			InFlightJobs: tracker.Snapshot(),
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			printError("could not encode status response", err)
+		}
+	})
+
+	printInfo("Serving /healthz and /status on", httpStatusAddrEnv)
+	if err := http.ListenAndServe(httpStatusAddrEnv, mux); err != nil {
+		printError("status server stopped", err)
+	}
+}
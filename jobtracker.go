@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jobActive states mirror Stash's JobStatus enum. A job in one of these
+// states is still occupying Stash's scan queue.
+var jobActiveStates = map[string]bool{
+	"READY":   true,
+	"RUNNING": true,
+}
+
+type trackedJob struct {
+	ID         string   `json:"id"`
+	Paths      []string `json:"paths"`
+	Status     string   `json:"status"`
+	journalIDs []string
+}
+
+// JobTracker follows metadataScan jobs from submission to completion so the
+// watcher never queues a second scan that overlaps one Stash is already
+// running. It also exposes a snapshot of in-flight jobs for /status.
+type JobTracker struct {
+	endpoint string
+	auth     bool
+	journal  *eventJournal
+
+	mu   sync.Mutex
+	jobs map[string]*trackedJob
+}
+
+func newJobTracker(endpoint string, auth bool, journal *eventJournal) *JobTracker {
+	t := &JobTracker{
+		endpoint: endpoint,
+		auth:     auth,
+		journal:  journal,
+		jobs:     make(map[string]*trackedJob),
+	}
+
+	go t.pollLoop()
+	go t.subscribeLoop()
+
+	return t
+}
+
+// Overlaps reports whether any in-flight job covers (or is covered by) any
+// of the given paths. An empty paths list represents a whole-library scan,
+// which overlaps with anything in flight.
+func (t *JobTracker) Overlaps(paths []string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, j := range t.jobs {
+		if !jobActiveStates[j.Status] {
+			continue
+		}
+		if len(paths) == 0 || len(j.Paths) == 0 {
+			return true
+		}
+		for _, a := range paths {
+			for _, b := range j.Paths {
+				if pathsOverlap(a, b) {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+func pathsOverlap(a, b string) bool {
+	a, b = filepath.Clean(a), filepath.Clean(b)
+	if a == b {
+		return true
+	}
+	return strings.HasPrefix(a, b+string(filepath.Separator)) ||
+		strings.HasPrefix(b, a+string(filepath.Separator))
+}
+
+// Track registers a newly submitted job so it can be polled/subscribed to.
+// journalIDs are the event journal entries folded into this job; they're
+// acknowledged once the job leaves an active state.
+func (t *JobTracker) Track(id string, paths []string, journalIDs []string) {
+	if id == "" {
+		return
+	}
+
+	t.mu.Lock()
+	t.jobs[id] = &trackedJob{ID: id, Paths: paths, Status: "READY", journalIDs: journalIDs}
+	t.mu.Unlock()
+}
+
+func (t *JobTracker) updateStatus(id, status string) {
+	t.mu.Lock()
+	j, ok := t.jobs[id]
+	if !ok {
+		t.mu.Unlock()
+		return
+	}
+
+	j.Status = status
+	if jobActiveStates[status] {
+		t.mu.Unlock()
+		return
+	}
+
+	delete(t.jobs, id)
+	t.mu.Unlock()
+
+	printVerbose("Job finished:", id, status)
+	for _, journalID := range j.journalIDs {
+		t.journal.MarkDone(journalID)
+	}
+}
+
+// Snapshot returns the in-flight jobs, for reporting over /status.
+func (t *JobTracker) Snapshot() []trackedJob {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	out := make([]trackedJob, 0, len(t.jobs))
+	for _, j := range t.jobs {
+		out = append(out, *j)
+	}
+	return out
+}
+
+const findJobQuery = `{"query":"query($id: ID!){ findJob(input: {id: $id}) { id status } }","variables":{"id":%s}}`
+
+type findJobResponse struct {
+	Data struct {
+		FindJob *struct {
+			ID     string `json:"id"`
+			Status string `json:"status"`
+		} `json:"findJob"`
+	} `json:"data"`
+}
+
+// pollLoop is the fallback (and, for simple deployments, the only) means of
+// discovering job completion: it periodically asks Stash about every job
+// we're still tracking via findJob.
+func (t *JobTracker) pollLoop() {
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for _, j := range t.Snapshot() {
+			status, err := t.queryJobStatus(j.ID)
+			if err != nil {
+				printDebug("could not poll job status", j.ID, err)
+				continue
+			}
+			t.updateStatus(j.ID, status)
+		}
+	}
+}
+
+func (t *JobTracker) queryJobStatus(id string) (string, error) {
+	idJSON, _ := json.Marshal(id)
+	body := fmt.Sprintf(findJobQuery, idJSON)
+	req, err := http.NewRequest(http.MethodPost, t.endpoint, strings.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if t.auth {
+		if apiKey, ok := os.LookupEnv("STASH_API_KEY"); ok {
+			req.Header.Set("ApiKey", apiKey)
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	var parsed findJobResponse
+	if err := json.Unmarshal(respBody, &parsed); err != nil {
+		return "", err
+	}
+	if parsed.Data.FindJob == nil {
+		// job is no longer known to Stash; treat as finished
+		return "FINISHED", nil
+	}
+
+	return parsed.Data.FindJob.Status, nil
+}
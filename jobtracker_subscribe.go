@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// jobsSubscribeMessage mirrors the "next" message shape of Stash's
+// jobsSubscribe GraphQL subscription, delivered over the graphql-ws
+// subprotocol.
+type jobsSubscribeMessage struct {
+	Type    string `json:"type"`
+	Payload struct {
+		Data struct {
+			JobsSubscribe struct {
+				Job struct {
+					ID     string `json:"id"`
+					Status string `json:"status"`
+				} `json:"job"`
+			} `json:"jobsSubscribe"`
+		} `json:"data"`
+	} `json:"payload"`
+}
+
+// subscribeLoop is a best-effort enhancement over pollLoop: when Stash's
+// websocket subscription endpoint is reachable, job status updates arrive
+// immediately instead of waiting for the next poll tick. If the endpoint
+// can't be reached (older Stash, proxy stripping Upgrade, etc.) this just
+// backs off and retries, and the watcher keeps working off pollLoop alone.
+func (t *JobTracker) subscribeLoop() {
+	wsURL, err := graphqlEndpointToWebsocket(t.endpoint)
+	if err != nil {
+		printDebug("job subscription disabled:", err)
+		return
+	}
+
+	backoff := 2 * time.Second
+	for {
+		if err := t.subscribeOnce(wsURL); err != nil {
+			printDebug("job subscription error, retrying:", err)
+		}
+
+		time.Sleep(backoff)
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+func (t *JobTracker) subscribeOnce(wsURL string) error {
+	header := http.Header{}
+	if t.auth {
+		if apiKey, ok := os.LookupEnv("STASH_API_KEY"); ok {
+			header.Set("ApiKey", apiKey)
+		}
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, header)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.WriteJSON(map[string]string{"type": "connection_init"}); err != nil {
+		return err
+	}
+
+	subscribe := map[string]any{
+		"id":   "stash-watch-jobs",
+		"type": "subscribe",
+		"payload": map[string]any{
+			"query": "subscription { jobsSubscribe { job { id status } } }",
+		},
+	}
+	if err := conn.WriteJSON(subscribe); err != nil {
+		return err
+	}
+
+	printInfo("Subscribed to Stash job updates at", wsURL)
+
+	for {
+		_, raw, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+
+		var msg jobsSubscribeMessage
+		if err := json.Unmarshal(raw, &msg); err != nil {
+			printDebug("could not parse job subscription message", err)
+			continue
+		}
+		if msg.Type != "next" {
+			continue
+		}
+
+		job := msg.Payload.Data.JobsSubscribe.Job
+		if job.ID != "" {
+			t.updateStatus(job.ID, job.Status)
+		}
+	}
+}
+
+// graphqlEndpointToWebsocket rewrites an http(s) GraphQL endpoint URL into
+// its ws(s) equivalent, which is what Stash serves subscriptions on.
+func graphqlEndpointToWebsocket(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	}
+
+	return u.String(), nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import "testing"
+
+func newTestTracker() *JobTracker {
+	return &JobTracker{jobs: make(map[string]*trackedJob)}
+}
+
+func TestJobTrackerOverlaps(t *testing.T) {
+	tr := newTestTracker()
+	tr.Track("job-1", []string{"/library/movies"}, nil)
+
+	tests := []struct {
+		name  string
+		paths []string
+		want  bool
+	}{
+		{name: "descendant of an in-flight job overlaps", paths: []string{"/library/movies/action"}, want: true},
+		{name: "ancestor of an in-flight job overlaps", paths: []string{"/library"}, want: true},
+		{name: "unrelated path does not overlap", paths: []string{"/library/shows"}, want: false},
+		{name: "whole-library scan overlaps anything in flight", paths: nil, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tr.Overlaps(tt.paths); got != tt.want {
+				t.Errorf("Overlaps(%v) = %v, want %v", tt.paths, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJobTrackerOverlapsIgnoresFinishedJobs(t *testing.T) {
+	tr := newTestTracker()
+	tr.Track("job-1", []string{"/library/movies"}, nil)
+	tr.updateStatus("job-1", "FINISHED")
+
+	if tr.Overlaps([]string{"/library/movies"}) {
+		t.Error("expected a finished job to no longer overlap")
+	}
+}
+
+func TestJobTrackerUpdateStatusAcknowledgesJournal(t *testing.T) {
+	journal := newTestJournal(t)
+	tr := &JobTracker{jobs: make(map[string]*trackedJob), journal: journal}
+
+	id := journal.Record("/library/movies/a.mp4", "create")
+	tr.Track("job-1", []string{"/library/movies"}, []string{id})
+
+	tr.updateStatus("job-1", "FINISHED")
+
+	latest, _, err := journal.loadLatest()
+	if err != nil {
+		t.Fatalf("loadLatest: %v", err)
+	}
+	if !latest[id].Done {
+		t.Fatalf("expected journal entry %s to be acknowledged once its job finished", id)
+	}
+	if len(tr.Snapshot()) != 0 {
+		t.Fatalf("expected finished job to be dropped from tracking, got %+v", tr.Snapshot())
+	}
+}
+
+func TestPathsOverlap(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{a: "/library/movies", b: "/library/movies", want: true},
+		{a: "/library/movies", b: "/library/movies/action", want: true},
+		{a: "/library/movies/action", b: "/library/movies", want: true},
+		{a: "/library/movies", b: "/library/movies2", want: false},
+		{a: "/library/movies", b: "/library/shows", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := pathsOverlap(tt.a, tt.b); got != tt.want {
+			t.Errorf("pathsOverlap(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestGraphqlEndpointToWebsocket(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		want     string
+	}{
+		{endpoint: "http://localhost:9999/graphql", want: "ws://localhost:9999/graphql"},
+		{endpoint: "https://stash.example.com/graphql", want: "wss://stash.example.com/graphql"},
+	}
+
+	for _, tt := range tests {
+		got, err := graphqlEndpointToWebsocket(tt.endpoint)
+		if err != nil {
+			t.Fatalf("graphqlEndpointToWebsocket(%q): %v", tt.endpoint, err)
+		}
+		if got != tt.want {
+			t.Errorf("graphqlEndpointToWebsocket(%q) = %q, want %q", tt.endpoint, got, tt.want)
+		}
+	}
+}
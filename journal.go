@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var journalStateDirEnv string
+
+func init() {
+	journalStateDirEnv = os.Getenv("STASH_WATCH_STATE_DIR")
+}
+
+// journalEntry is one line of the append-only event journal. An entry with
+// Done set and no Path is an acknowledgement of an earlier entry with the
+// same ID, recorded once the scan it was folded into finishes in Stash.
+type journalEntry struct {
+	ID        string `json:"id"`
+	Path      string `json:"path,omitempty"`
+	Op        string `json:"op,omitempty"`
+	Timestamp int64  `json:"timestamp,omitempty"`
+	Done      bool   `json:"done,omitempty"`
+}
+
+// rootState tracks, per watched root, the last time its tree was known to
+// be fully accounted for. It's used to catch changes that happened while
+// the process wasn't running at all (journal entries only cover events the
+// process was alive to see).
+type rootState struct {
+	LastSeen map[string]int64 `json:"lastSeen"`
+}
+
+// eventJournal is a crash-safety net: every accepted filesystem event is
+// appended here before it's folded into a coalesced scan, and acknowledged
+// once the corresponding Stash job finishes. If the watcher dies mid-way
+// (crash, reboot, OOM), unacknowledged entries are replayed on the next
+// startup instead of silently being lost. A nil *eventJournal is valid and
+// makes every method a no-op, so the journal can be optional.
+type eventJournal struct {
+	eventsPath string
+	statePath  string
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+func newEventJournal(stateDir string) (*eventJournal, error) {
+	if stateDir == "" {
+		return nil, nil
+	}
+
+	if err := os.MkdirAll(stateDir, 0o755); err != nil {
+		return nil, fmt.Errorf("could not create state dir %q: %w", stateDir, err)
+	}
+
+	eventsPath := filepath.Join(stateDir, "events.jsonl")
+	f, err := os.OpenFile(eventsPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open event journal %q: %w", eventsPath, err)
+	}
+
+	return &eventJournal{
+		eventsPath: eventsPath,
+		statePath:  filepath.Join(stateDir, "roots.json"),
+		f:          f,
+	}, nil
+}
+
+// Record appends an accepted event to the journal and returns the entry's
+// ID, to be passed to MarkDone once the scan covering it completes.
+func (j *eventJournal) Record(path, op string) string {
+	if j == nil {
+		return ""
+	}
+
+	id := fmt.Sprintf("%d-%s", time.Now().UnixNano(), path)
+	j.append(journalEntry{ID: id, Path: path, Op: op, Timestamp: time.Now().UnixNano()})
+	return id
+}
+
+// MarkDone records that the scan covering id has completed in Stash.
+func (j *eventJournal) MarkDone(id string) {
+	if j == nil || id == "" {
+		return
+	}
+	j.append(journalEntry{ID: id, Done: true})
+}
+
+func (j *eventJournal) append(entry journalEntry) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		printError("could not marshal journal entry", err)
+		return
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if _, err := j.f.Write(append(data, '\n')); err != nil {
+		printError("could not write journal entry", err)
+	}
+}
+
+// Replay reads back the event journal and queues a scan for every entry
+// that was never acknowledged, i.e. every event accepted before the
+// watcher stopped but whose scan never completed (or was never even sent).
+// Each replayed path is re-queued under its original entry's ID (via
+// addReplay) so that the scan it's folded into this time around
+// acknowledges that same entry, instead of leaving it pending forever while
+// a new, unrelated entry gets acknowledged in its place.
+func (j *eventJournal) Replay(coalescer *scanCoalescer) {
+	if j == nil {
+		return
+	}
+
+	latest, order, err := j.loadLatest()
+	if err != nil {
+		printError("could not read event journal", err)
+		return
+	}
+
+	var pending int
+	for _, id := range order {
+		e := latest[id]
+		if e.Done {
+			continue
+		}
+		pending++
+		coalescer.addReplay(e.Path, e.ID)
+	}
+
+	if pending > 0 {
+		printInfo("Replaying", pending, "unacknowledged event(s) from the previous run")
+	}
+
+	if err := j.compact(latest, order); err != nil {
+		printError("could not compact event journal", err)
+	}
+}
+
+// loadLatest reads back the journal and collapses it to the latest known
+// state of each entry (an entry plus whether it was later acknowledged),
+// along with the order IDs were first seen in, so callers can iterate
+// deterministically.
+func (j *eventJournal) loadLatest() (map[string]journalEntry, []string, error) {
+	entries, err := readJournal(j.eventsPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	latest := make(map[string]journalEntry)
+	var order []string
+	for _, e := range entries {
+		if e.Done && e.Path == "" {
+			if prev, ok := latest[e.ID]; ok {
+				prev.Done = true
+				latest[e.ID] = prev
+			}
+			continue
+		}
+		if _, ok := latest[e.ID]; !ok {
+			order = append(order, e.ID)
+		}
+		latest[e.ID] = e
+	}
+
+	return latest, order, nil
+}
+
+// compact rewrites the journal file to contain only still-pending entries,
+// dropping acknowledged ones and collapsing the separate Record/MarkDone
+// lines accumulated for each entry into at most one line. Without this the
+// journal is append-only forever, which defeats the "small on-disk journal"
+// this is meant to be for any watcher that runs for a long time.
+func (j *eventJournal) compact(latest map[string]journalEntry, order []string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	tmpPath := j.eventsPath + ".compact"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("could not create compacted journal %q: %w", tmpPath, err)
+	}
+
+	for _, id := range order {
+		e := latest[id]
+		if e.Done {
+			continue
+		}
+		data, err := json.Marshal(e)
+		if err != nil {
+			continue
+		}
+		if _, err := f.Write(append(data, '\n')); err != nil {
+			f.Close()
+			return fmt.Errorf("could not write compacted journal: %w", err)
+		}
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, j.eventsPath); err != nil {
+		return fmt.Errorf("could not replace event journal: %w", err)
+	}
+
+	if j.f != nil {
+		j.f.Close()
+	}
+	newF, err := os.OpenFile(j.eventsPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("could not reopen event journal %q: %w", j.eventsPath, err)
+	}
+	j.f = newF
+
+	return nil
+}
+
+func readJournal(path string) ([]journalEntry, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []journalEntry
+	scanner := bufio.NewScanner(f)
+	// journal lines are small JSON objects, but allow generous room for
+	// long paths
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			printDebug("skipping malformed journal line:", err)
+			continue
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, scanner.Err()
+}
+
+// ReplayRoots walks every watched root comparing file mtimes against the
+// last time that root was known to be fully accounted for, to catch
+// changes that happened while the process wasn't running at all (a clean
+// shutdown, a host reboot mid-rsync, etc. all look the same from here).
+func (j *eventJournal) ReplayRoots(roots []string, filter *pathFilter, coalescer *scanCoalescer) {
+	if j == nil {
+		return
+	}
+
+	state := j.loadState()
+	if state.LastSeen == nil {
+		state.LastSeen = make(map[string]int64)
+	}
+
+	now := time.Now()
+	for _, root := range roots {
+		last := time.Unix(0, state.LastSeen[root])
+
+		found := 0
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return nil
+			}
+			if info.ModTime().After(last) && filter.Allow(path, false) {
+				coalescer.add(path, "replay")
+				found++
+			}
+			return nil
+		})
+		if err != nil {
+			printError("error walking watched root", root, err)
+		}
+		if found > 0 {
+			printInfo("Found", found, "file(s) changed under", root, "while the watcher wasn't running")
+		}
+
+		state.LastSeen[root] = now.UnixNano()
+	}
+
+	j.saveState(state)
+}
+
+func (j *eventJournal) loadState() rootState {
+	var state rootState
+
+	data, err := os.ReadFile(j.statePath)
+	if err != nil {
+		return state
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		printError("could not parse journal state", err)
+	}
+
+	return state
+}
+
+func (j *eventJournal) saveState(state rootState) {
+	data, err := json.Marshal(state)
+	if err != nil {
+		printError("could not marshal journal state", err)
+		return
+	}
+
+	if err := os.WriteFile(j.statePath, data, 0o644); err != nil {
+		printError("could not write journal state", err)
+	}
+}
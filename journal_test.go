@@ -0,0 +1,118 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestJournal(t *testing.T) *eventJournal {
+	t.Helper()
+
+	j, err := newEventJournal(t.TempDir())
+	if err != nil {
+		t.Fatalf("newEventJournal: %v", err)
+	}
+	t.Cleanup(func() { j.f.Close() })
+	return j
+}
+
+// newTestCoalescer returns a coalescer backed by j whose flush never fires
+// on its own (the coalesce window is effectively infinite), so tests can
+// drain c.paths themselves and assert on the resulting pathOp.
+func drainOne(c *scanCoalescer) pathOp {
+	return <-c.paths
+}
+
+func TestRecordAndMarkDoneRoundTrip(t *testing.T) {
+	j := newTestJournal(t)
+
+	id := j.Record("/library/movies/a.mp4", "create")
+	if id == "" {
+		t.Fatal("Record returned an empty ID")
+	}
+
+	latest, order, err := j.loadLatest()
+	if err != nil {
+		t.Fatalf("loadLatest: %v", err)
+	}
+	if len(order) != 1 || latest[id].Done {
+		t.Fatalf("expected one pending entry, got %+v", latest)
+	}
+
+	j.MarkDone(id)
+
+	latest, _, err = j.loadLatest()
+	if err != nil {
+		t.Fatalf("loadLatest: %v", err)
+	}
+	if !latest[id].Done {
+		t.Fatalf("entry %s not marked done: %+v", id, latest[id])
+	}
+}
+
+// TestReplayAcknowledgesOriginalEntry simulates the crash/restart case a
+// reviewer flagged: a replayed entry must converge (be acknowledgeable)
+// under its original ID, not a freshly minted one that nothing ever marks
+// done.
+func TestReplayAcknowledgesOriginalEntry(t *testing.T) {
+	j := newTestJournal(t)
+
+	id := j.Record("/library/movies/a.mp4", "create")
+
+	coalescer := &scanCoalescer{paths: make(chan pathOp, 1), journal: j}
+	j.Replay(coalescer)
+
+	replayed := drainOne(coalescer)
+	if replayed.id != id {
+		t.Fatalf("replay re-queued under id %q, want original id %q", replayed.id, id)
+	}
+
+	// the scan folded in the replayed op completes and acknowledges it
+	j.MarkDone(replayed.id)
+
+	latest, _, err := j.loadLatest()
+	if err != nil {
+		t.Fatalf("loadLatest: %v", err)
+	}
+	if !latest[id].Done {
+		t.Fatalf("original entry %s still pending after replay+ack: %+v", id, latest[id])
+	}
+
+	// a second restart should find nothing left to replay
+	coalescer2 := &scanCoalescer{paths: make(chan pathOp, 1), journal: j}
+	j.Replay(coalescer2)
+	select {
+	case pe := <-coalescer2.paths:
+		t.Fatalf("unexpected replay after entry was acknowledged: %+v", pe)
+	default:
+	}
+}
+
+func TestCompactDropsAcknowledgedEntries(t *testing.T) {
+	j := newTestJournal(t)
+
+	doneID := j.Record("/library/movies/done.mp4", "create")
+	j.MarkDone(doneID)
+	pendingID := j.Record("/library/movies/pending.mp4", "create")
+
+	coalescer := &scanCoalescer{paths: make(chan pathOp, 1), journal: j}
+	j.Replay(coalescer)
+	<-coalescer.paths // drain the one pending replay so Replay's send doesn't block future calls
+
+	data, err := os.ReadFile(filepath.Join(filepath.Dir(j.eventsPath), "events.jsonl"))
+	if err != nil {
+		t.Fatalf("could not read compacted journal: %v", err)
+	}
+
+	latest, order, err := j.loadLatest()
+	if err != nil {
+		t.Fatalf("loadLatest: %v", err)
+	}
+	if len(order) != 1 || order[0] != pendingID {
+		t.Fatalf("compacted journal should only retain the pending entry, got order=%v latest=%+v", order, latest)
+	}
+	if len(data) == 0 {
+		t.Fatal("compacted journal file is empty, expected the still-pending entry")
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -12,13 +13,10 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
-	"regexp"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
-
-	"github.com/fsnotify/fsnotify"
 )
 
 type watcher []string
@@ -62,7 +60,7 @@ var doAuthEnv bool
 var endpointEnv string
 var scheduledScanIntervalMinsEnv string
 var client *http.Client
-var scanBody string
+var scanOptionsFragment string
 
 func init() {
 	flag.Var(&watcherFlag, "watcher", "Path(s) to add watchers to (may be specified multiple times).")
@@ -80,9 +78,10 @@ func init() {
 	_, scanGenerateSprites := os.LookupEnv("STASH_WATCH_GEN_SPRITE")
 	_, scanGenerateThumbnails := os.LookupEnv("STASH_WATCH_GEN_THUMB")
 
-	str := `{
-"query": "mutation {
-	metadataScan (input: {
+	// fragment of the metadataScan input shared by every scan request; the
+	// paths list is spliced in per-request by buildScanBody since it varies
+	// with what the coalescer accumulated.
+	scanOptionsFragment = `
 		rescan: ` + fmt.Sprintf("%t", scanRescan) + `,
 		scanGenerateClipPreviews: ` + fmt.Sprintf("%t", scanGenerateClipPreviews) + `,
 		scanGenerateCovers: ` + fmt.Sprintf("%t", scanGenerateCovers) + `,
@@ -90,21 +89,13 @@ func init() {
 		scanGeneratePhashes: ` + fmt.Sprintf("%t", scanGeneratePhashes) + `,
 		scanGeneratePreviews: ` + fmt.Sprintf("%t", scanGeneratePreviews) + `,
 		scanGenerateSprites: ` + fmt.Sprintf("%t", scanGenerateSprites) + `,
-		scanGenerateThumbnails: ` + fmt.Sprintf("%t", scanGenerateThumbnails) + `
-	})}"
-}`
-	printDebug("constructed scan request body:\n", str)
+		scanGenerateThumbnails: ` + fmt.Sprintf("%t", scanGenerateThumbnails)
 
-	str = regexp.MustCompile(`\n`).ReplaceAllString(str, "")
-	scanBody = regexp.MustCompile(`\s+`).ReplaceAllString(str, " ")
+	printDebug("scan options fragment:", scanOptionsFragment)
 
-	printDebug("final scan request body:", scanBody)
+	endpointEnv = os.Getenv("STASH_API_ENDPOINT")
 
 	var ok bool
-	endpointEnv, ok = os.LookupEnv("STASH_API_ENDPOINT")
-	if !ok {
-		log.Fatal("Stash API endpoint is unset")
-	}
 	scheduledScanIntervalMinsEnv, ok = os.LookupEnv("STASH_SCAN_INTERVAL_MINS")
 	if !ok {
 		scheduledScanIntervalMinsEnv = "30"
@@ -168,21 +159,64 @@ func printInfo(s ...any) {
 	log.Println(strings.Join(args, " "))
 }
 
-func sendScanRequest(endpoint string, useAuthentication bool) {
-	body := []byte(scanBody)
+// buildScanBody constructs the metadataScan mutation body for the given set
+// of paths. An empty paths list scans the whole library, matching the
+// previous (pre-coalescing) behavior used for scheduled scans. paths is
+// passed as a GraphQL variable rather than spliced into the query string so
+// that path names containing quotes or other JSON-significant characters
+// can't break the request.
+func buildScanBody(paths []string) string {
+	query := `mutation($paths: [String!]) { metadataScan (input: { paths: $paths, ` + scanOptionsFragment + ` }) }`
+
+	body := struct {
+		Query     string         `json:"query"`
+		Variables map[string]any `json:"variables"`
+	}{
+		Query:     query,
+		Variables: map[string]any{"paths": paths},
+	}
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		// paths are plain filesystem strings; Marshal cannot fail on them
+		log.Fatal("could not marshal scan request body", err)
+	}
+
+	str := string(data)
+	printDebug("scan request body:", str)
+
+	return str
+}
+
+// scanResponse is the shape of the metadataScan mutation's GraphQL response;
+// the mutation resolves to the ID of the job it queued.
+type scanResponse struct {
+	Data struct {
+		MetadataScan string `json:"metadataScan"`
+	} `json:"data"`
+	Errors []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+// sendScanRequest fires a metadataScan mutation and returns the queued
+// job's ID so callers (the JobTracker) can follow it to completion.
+func sendScanRequest(endpoint string, useAuthentication bool, paths []string) (string, error) {
+	body := []byte(buildScanBody(paths))
 	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
 	if err != nil {
 		printError("could not create request", err)
-		return
+		return "", err
 	}
 
 	// does not support cookie-based authentication
 	if useAuthentication {
 		stashAPIKey, ok := os.LookupEnv("STASH_API_KEY")
 		if !ok {
-			printError(`authentication requested but API key is unset
+			err := errors.New(`authentication requested but API key is unset
 (hint: make sure to include STASH_API_KEY environment variable)`)
-			return
+			printError(err)
+			return "", err
 		}
 
 		req.Header.Set("ApiKey", stashAPIKey)
@@ -193,37 +227,32 @@ func sendScanRequest(endpoint string, useAuthentication bool) {
 	resp, err := client.Do(req)
 	if err != nil {
 		printError("error making http request", err)
-		return
+		return "", err
 	}
-
-	io.Copy(io.Discard, resp.Body) // <= NOTE must read response fully before closing for keep-alive
 	defer resp.Body.Close()
-}
 
-func watchSubdirs(dir string, wat *fsnotify.Watcher) error {
-	dirContents, err := os.ReadDir(dir)
+	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return err
+		printError("error reading response body", err)
+		return "", err
 	}
 
-	for _, p := range dirContents {
-		if p.IsDir() {
-			abs := filepath.Join(dir, p.Name())
+	var parsed scanResponse
+	if err := json.Unmarshal(respBody, &parsed); err != nil {
+		printError("error parsing scan response", err)
+		return "", err
+	}
 
-			err = wat.Add(abs)
-			if err != nil {
-				log.Fatal(err)
-			}
-			printVerbose("Now watching", abs)
-			// recurse
-			watchSubdirs(abs, wat)
-		}
+	if len(parsed.Errors) > 0 {
+		err := fmt.Errorf("metadataScan returned errors: %s", parsed.Errors[0].Message)
+		printError(err)
+		return "", err
 	}
 
-	return nil
+	return parsed.Data.MetadataScan, nil
 }
 
-func dedupLoop(wat *fsnotify.Watcher) {
+func dedupLoop(wat watchBackend, coalescer *scanCoalescer, filter *pathFilter) {
 	var (
 		// wait 100ms for new events; each new event resets the timer
 		waitFor = 100 * time.Millisecond
@@ -233,10 +262,10 @@ func dedupLoop(wat *fsnotify.Watcher) {
 		timers = make(map[string]*time.Timer)
 
 		// callback
-		processOp = func(event fsnotify.Event) {
+		processOp = func(event fsEvent) {
 			func() {
 				// DO PROCESSING
-				if event.Has(fsnotify.Create) {
+				if event.Has(opCreate) {
 					printVerbose("created path item:", event.Name)
 
 					abs, err := filepath.Abs(event.Name)
@@ -252,9 +281,23 @@ func dedupLoop(wat *fsnotify.Watcher) {
 					}
 
 					if !f.IsDir() {
-						printInfo("Files changed, sending update:", abs)
-						// send update
-						sendScanRequest(endpointEnv, doAuthEnv)
+						if !filter.Allow(abs, false) {
+							printDebug("Filtered out:", abs)
+							return
+						}
+						go func() {
+							if !waitForStableFile(abs) {
+								printDebug("Path disappeared before it stabilized:", abs)
+								return
+							}
+							printInfo("File stable, queueing scan:", abs)
+							coalescer.add(abs, "create")
+						}()
+						return
+					}
+
+					if !filter.Allow(abs, true) {
+						printDebug("Filtered out directory, not watching:", abs)
 						return
 					}
 
@@ -264,14 +307,38 @@ func dedupLoop(wat *fsnotify.Watcher) {
 					}
 					printInfo("New directory detected, now watching directory: ", abs)
 
+					// the directory may have arrived with files already in
+					// it (a move or extracted archive), which never fire
+					// their own Create events once we're watching
+					go scanTreeOnceStable(abs, filter, coalescer)
+
 					return
 				}
 
 				// can only reach if fs operation is write or remove
 
-				printInfo("Files changed, sending update:", event.Name)
-				// send update here
-				sendScanRequest(endpointEnv, doAuthEnv)
+				if !filter.Allow(event.Name, false) {
+					printDebug("Filtered out:", event.Name)
+					return
+				}
+
+				if event.Has(opRemove) {
+					printInfo("Files changed, queueing scan:", event.Name)
+					coalescer.add(event.Name, "remove")
+					return
+				}
+
+				// write: wait for the file to stop changing before
+				// scanning, so Stash doesn't see a truncated in-progress
+				// copy or transcode
+				go func() {
+					if !waitForStableFile(event.Name) {
+						printDebug("Path disappeared before it stabilized:", event.Name)
+						return
+					}
+					printInfo("File stable, queueing scan:", event.Name)
+					coalescer.add(event.Name, "write")
+				}()
 			}()
 
 			// destroying timer only necessary if you have many files
@@ -282,7 +349,7 @@ func dedupLoop(wat *fsnotify.Watcher) {
 	)
 	for {
 		select {
-		case event, ok := <-wat.Events:
+		case event, ok := <-wat.Events():
 			if !ok { // channel was closed
 				return
 			}
@@ -291,7 +358,7 @@ func dedupLoop(wat *fsnotify.Watcher) {
 			// inode is gone = watcher is gone
 
 			// only listen on these operations
-			if !event.Has(fsnotify.Write) && !event.Has(fsnotify.Remove) && !event.Has(fsnotify.Create) {
+			if !event.Has(opWrite) && !event.Has(opRemove) && !event.Has(opCreate) {
 				continue
 			}
 
@@ -312,7 +379,7 @@ func dedupLoop(wat *fsnotify.Watcher) {
 
 			t.Reset(waitFor)
 
-		case err, ok := <-wat.Errors:
+		case err, ok := <-wat.Errors():
 			if !ok { // channel was closed
 				return // SOFT ERROR
 			}
@@ -330,23 +397,44 @@ func main() {
 		log.Fatal("Error: no watcher arguments provided. ",
 			"Use '--watcher <PATH>' to start watching directories.")
 	}
+	if endpointEnv == "" {
+		log.Fatal("Stash API endpoint is unset")
+	}
+
+	printInfo("Using watch backend:", watchBackendEnv)
+
+	journal, err := newEventJournal(journalStateDirEnv)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	jobTracker := newJobTracker(endpointEnv, doAuthEnv, journal)
+	go serveStatus(jobTracker)
+
+	coalescer := newScanCoalescer(jobTracker, journal)
+
+	filter, err := newPathFilter()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	journal.Replay(coalescer)
+	journal.ReplayRoots(watcherFlag, filter, coalescer)
 
 	for _, w := range watcherFlag {
-		wat, err := fsnotify.NewWatcher()
+		wat, err := newWatchBackend(watchBackendEnv)
 		if err != nil {
 			log.Fatal(err)
 		}
 		defer wat.Close()
 
-		go dedupLoop(wat)
+		go dedupLoop(wat, coalescer, filter)
 
-		err = wat.Add(w)
+		err = wat.AddRecursive(w)
 		if err != nil {
 			log.Fatal(err)
 		}
 		printInfo("Initial watcher started at:", w)
-
-		go watchSubdirs(w, wat)
 	}
 
 	d, err := strconv.Atoi(scheduledScanIntervalMinsEnv)
@@ -360,8 +448,15 @@ func main() {
 		for {
 			select {
 			case <-ticker.C:
+				if jobTracker.Overlaps(nil) {
+					printInfo("Skipping scheduled scan; a scan is already running in Stash")
+					continue
+				}
 				printInfo("Running scheduled scan")
-				sendScanRequest(endpointEnv, doAuthEnv)
+				jobID, err := sendScanRequest(endpointEnv, doAuthEnv, nil)
+				if err == nil {
+					jobTracker.Track(jobID, nil, nil)
+				}
 			}
 		}
 	}()
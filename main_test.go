@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestBuildScanBodyProducesValidJSON(t *testing.T) {
+	tests := []struct {
+		name  string
+		paths []string
+	}{
+		{name: "nil paths", paths: nil},
+		{name: "single path", paths: []string{"/single/path"}},
+		{name: "path with a quote", paths: []string{`/library/movies/"weird" folder`}},
+		{name: "multiple paths", paths: []string{"/a", "/b"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := buildScanBody(tt.paths)
+
+			if !json.Valid([]byte(body)) {
+				t.Fatalf("buildScanBody(%v) produced invalid JSON: %s", tt.paths, body)
+			}
+
+			var parsed struct {
+				Query     string `json:"query"`
+				Variables struct {
+					Paths []string `json:"paths"`
+				} `json:"variables"`
+			}
+			if err := json.Unmarshal([]byte(body), &parsed); err != nil {
+				t.Fatalf("could not unmarshal body: %v", err)
+			}
+
+			if !strings.Contains(parsed.Query, "$paths") {
+				t.Errorf("query does not reference $paths variable: %s", parsed.Query)
+			}
+			if len(parsed.Variables.Paths) != len(tt.paths) {
+				t.Errorf("variables.paths = %v, want %v", parsed.Variables.Paths, tt.paths)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+var (
+	stableInterval time.Duration
+	stableSamples  int
+)
+
+func init() {
+	secs := 5
+	if v, ok := os.LookupEnv("STASH_WATCH_STABLE_SECS"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatal("invalid STASH_WATCH_STABLE_SECS:", err)
+		}
+		secs = n
+	}
+	stableInterval = time.Duration(secs) * time.Second
+
+	samples := 2
+	if v, ok := os.LookupEnv("STASH_WATCH_STABLE_SAMPLES"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatal("invalid STASH_WATCH_STABLE_SAMPLES:", err)
+		}
+		samples = n
+	}
+	stableSamples = samples
+}
+
+// waitForStableFile blocks until path's size and mtime are unchanged across
+// stableSamples consecutive stat calls, stableInterval apart. This keeps
+// large in-flight copies/transcodes from being scanned (and thumbnailed or
+// phashed) while they're still being written. It returns false if path
+// disappears while waiting.
+func waitForStableFile(path string) bool {
+	size, mtime, ok := statSizeMtime(path)
+	if !ok {
+		return false
+	}
+
+	for stable := 1; stable < stableSamples; {
+		time.Sleep(stableInterval)
+
+		newSize, newMtime, ok := statSizeMtime(path)
+		if !ok {
+			return false
+		}
+
+		if newSize == size && newMtime.Equal(mtime) {
+			stable++
+			continue
+		}
+
+		size, mtime = newSize, newMtime
+		stable = 1
+	}
+
+	return true
+}
+
+func statSizeMtime(path string) (int64, time.Time, bool) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, time.Time{}, false
+	}
+	return info.Size(), info.ModTime(), true
+}
+
+// scanTreeOnceStable walks root for files and, for each one that passes
+// filter, waits for it to stabilize before queueing a scan. It's used for
+// directories created in one shot (e.g. a moved-in or extracted folder),
+// whose pre-existing contents never generate their own Create events.
+func scanTreeOnceStable(root string, filter *pathFilter, coalescer *scanCoalescer) {
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		if !filter.Allow(path, false) {
+			return nil
+		}
+
+		go func(p string) {
+			if !waitForStableFile(p) {
+				printDebug("Path disappeared before it stabilized:", p)
+				return
+			}
+			printInfo("File stable, queueing scan:", p)
+			coalescer.add(p, "create")
+		}(path)
+
+		return nil
+	})
+	if err != nil {
+		printError("error walking new directory", root, err)
+	}
+}
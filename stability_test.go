@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// withStableTuning temporarily lowers the stability gate's interval/sample
+// count so tests don't block for the real-world defaults (5s x 2 samples),
+// restoring the package-level settings afterward.
+func withStableTuning(t *testing.T, interval time.Duration, samples int) {
+	t.Helper()
+	origInterval, origSamples := stableInterval, stableSamples
+	stableInterval, stableSamples = interval, samples
+	t.Cleanup(func() { stableInterval, stableSamples = origInterval, origSamples })
+}
+
+func TestStatSizeMtime(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.mp4")
+	if err := os.WriteFile(path, []byte("hello"), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	size, _, ok := statSizeMtime(path)
+	if !ok {
+		t.Fatal("expected stat to succeed for an existing file")
+	}
+	if size != 5 {
+		t.Errorf("size = %d, want 5", size)
+	}
+
+	if _, _, ok := statSizeMtime(filepath.Join(dir, "missing")); ok {
+		t.Error("expected stat to fail for a missing file")
+	}
+}
+
+func TestWaitForStableFileReturnsOnceUnchanged(t *testing.T) {
+	withStableTuning(t, 10*time.Millisecond, 2)
+
+	path := filepath.Join(t.TempDir(), "a.mp4")
+	if err := os.WriteFile(path, []byte("hello"), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	if !waitForStableFile(path) {
+		t.Error("expected an untouched file to stabilize")
+	}
+}
+
+func TestWaitForStableFileReturnsFalseIfPathDisappears(t *testing.T) {
+	withStableTuning(t, 10*time.Millisecond, 2)
+
+	path := filepath.Join(t.TempDir(), "a.mp4")
+	if err := os.WriteFile(path, []byte("hello"), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		os.Remove(path)
+	}()
+
+	if waitForStableFile(path) {
+		t.Error("expected waitForStableFile to report false once the path disappears")
+	}
+}
+
+func TestWaitForStableFileWaitsOutInFlightWrites(t *testing.T) {
+	withStableTuning(t, 10*time.Millisecond, 2)
+
+	path := filepath.Join(t.TempDir(), "a.mp4")
+	if err := os.WriteFile(path, []byte("a"), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 3; i++ {
+			time.Sleep(5 * time.Millisecond)
+			os.WriteFile(path, []byte("growing"), 0o644)
+		}
+	}()
+
+	if !waitForStableFile(path) {
+		t.Error("expected the file to eventually stabilize")
+	}
+	<-done
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// fsOp is a backend-agnostic set of filesystem event flags, mirroring the
+// subset of fsnotify.Op that dedupLoop cares about. This lets dedupLoop stay
+// oblivious to which concrete watcher implementation (fsnotify or notify) is
+// in use.
+type fsOp uint32
+
+const (
+	opCreate fsOp = 1 << iota
+	opWrite
+	opRemove
+	opRename
+	opChmod
+)
+
+// fsEvent is a backend-agnostic filesystem event.
+type fsEvent struct {
+	Name string
+	Op   fsOp
+}
+
+func (e fsEvent) Has(op fsOp) bool {
+	return e.Op&op != 0
+}
+
+// watchBackend abstracts over the mechanism used to receive filesystem
+// events for a watched tree. fsnotifyBackend watches each directory
+// individually (and must be told about new subdirectories via Add), while
+// the notify-tagged backend watches an entire tree recursively in one call.
+type watchBackend interface {
+	// Add starts watching path non-recursively. Implementations that watch
+	// recursively may treat this as a no-op once the containing root is
+	// already covered.
+	Add(path string) error
+	// AddRecursive starts watching root and everything created under it.
+	AddRecursive(root string) error
+	Events() <-chan fsEvent
+	Errors() <-chan error
+	Close() error
+}
+
+const (
+	backendFsnotify = "fsnotify"
+	backendNotify   = "notify"
+)
+
+var watchBackendEnv string
+
+func init() {
+	watchBackendEnv = backendFsnotify
+	if v, ok := os.LookupEnv("STASH_WATCH_BACKEND"); ok {
+		watchBackendEnv = v
+	}
+	flag.StringVar(&watchBackendEnv, "watch-backend", watchBackendEnv,
+		"Filesystem watch backend to use: fsnotify or notify (recursive, requires building with -tags notify).")
+}
+
+func newWatchBackend(name string) (watchBackend, error) {
+	switch name {
+	case backendFsnotify:
+		return newFsnotifyBackend()
+	case backendNotify:
+		return newNotifyBackend()
+	default:
+		return nil, fmt.Errorf("unknown watch backend %q (want %q or %q)", name, backendFsnotify, backendNotify)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// fsnotifyBackend is the default watchBackend. It watches directories one at
+// a time and relies on watchSubdirs/Add to pick up newly created
+// subdirectories, since fsnotify has no native recursive mode.
+type fsnotifyBackend struct {
+	wat    *fsnotify.Watcher
+	events chan fsEvent
+	errors chan error
+}
+
+func newFsnotifyBackend() (watchBackend, error) {
+	wat, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	b := &fsnotifyBackend{
+		wat:    wat,
+		events: make(chan fsEvent),
+		errors: make(chan error),
+	}
+
+	go b.run()
+
+	return b, nil
+}
+
+func (b *fsnotifyBackend) run() {
+	for {
+		select {
+		case event, ok := <-b.wat.Events:
+			if !ok {
+				close(b.events)
+				return
+			}
+			b.events <- fsEvent{Name: event.Name, Op: convertFsnotifyOp(event.Op)}
+
+		case err, ok := <-b.wat.Errors:
+			if !ok {
+				close(b.errors)
+				return
+			}
+			b.errors <- err
+		}
+	}
+}
+
+func convertFsnotifyOp(op fsnotify.Op) fsOp {
+	var out fsOp
+	if op.Has(fsnotify.Create) {
+		out |= opCreate
+	}
+	if op.Has(fsnotify.Write) {
+		out |= opWrite
+	}
+	if op.Has(fsnotify.Remove) {
+		out |= opRemove
+	}
+	if op.Has(fsnotify.Rename) {
+		out |= opRename
+	}
+	if op.Has(fsnotify.Chmod) {
+		out |= opChmod
+	}
+	return out
+}
+
+func (b *fsnotifyBackend) Add(path string) error {
+	return b.wat.Add(path)
+}
+
+// AddRecursive walks root and adds a watch for every directory found, since
+// fsnotify only watches the directories it's explicitly told about.
+func (b *fsnotifyBackend) AddRecursive(root string) error {
+	if err := b.wat.Add(root); err != nil {
+		return err
+	}
+	return b.watchSubdirs(root)
+}
+
+func (b *fsnotifyBackend) watchSubdirs(dir string) error {
+	dirContents, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range dirContents {
+		if p.IsDir() {
+			abs := filepath.Join(dir, p.Name())
+
+			if err := b.wat.Add(abs); err != nil {
+				log.Fatal(err)
+			}
+			printVerbose("Now watching", abs)
+			// recurse
+			b.watchSubdirs(abs)
+		}
+	}
+
+	return nil
+}
+
+func (b *fsnotifyBackend) Events() <-chan fsEvent {
+	return b.events
+}
+
+func (b *fsnotifyBackend) Errors() <-chan error {
+	return b.errors
+}
+
+func (b *fsnotifyBackend) Close() error {
+	return b.wat.Close()
+}
@@ -0,0 +1,11 @@
+//go:build !notify
+
+package main
+
+import "fmt"
+
+// newNotifyBackend is stubbed out unless the binary is built with
+// `-tags notify`, since that backend pulls in github.com/rjeczalik/notify.
+func newNotifyBackend() (watchBackend, error) {
+	return nil, fmt.Errorf("watch backend %q requires building with -tags notify", backendNotify)
+}
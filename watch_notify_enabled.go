@@ -0,0 +1,79 @@
+//go:build notify
+
+package main
+
+import (
+	"path/filepath"
+
+	"github.com/rjeczalik/notify"
+)
+
+// notifyBackend uses rjeczalik/notify to watch an entire tree natively
+// (inotify/FSEvents/ReadDirectoryChangesW), so newly created subtrees are
+// covered without the per-directory wat.Add fan-out that fsnotifyBackend
+// needs.
+type notifyBackend struct {
+	c      chan notify.EventInfo
+	events chan fsEvent
+	errors chan error
+}
+
+func newNotifyBackend() (watchBackend, error) {
+	b := &notifyBackend{
+		c:      make(chan notify.EventInfo, 256),
+		events: make(chan fsEvent),
+		errors: make(chan error),
+	}
+
+	go b.run()
+
+	return b, nil
+}
+
+func (b *notifyBackend) run() {
+	for ei := range b.c {
+		b.events <- fsEvent{Name: ei.Path(), Op: convertNotifyEvent(ei.Event())}
+	}
+	close(b.events)
+}
+
+func convertNotifyEvent(e notify.Event) fsOp {
+	var out fsOp
+	if e&notify.Create != 0 {
+		out |= opCreate
+	}
+	if e&notify.Write != 0 {
+		out |= opWrite
+	}
+	if e&notify.Remove != 0 {
+		out |= opRemove
+	}
+	if e&notify.Rename != 0 {
+		out |= opRename
+	}
+	return out
+}
+
+func (b *notifyBackend) Add(path string) error {
+	// notify already watches the whole tree recursively once AddRecursive
+	// has been called on an ancestor, so there's nothing extra to do here.
+	return nil
+}
+
+func (b *notifyBackend) AddRecursive(root string) error {
+	return notify.Watch(filepath.Join(root, "..."), b.c, notify.Create, notify.Write, notify.Remove, notify.Rename)
+}
+
+func (b *notifyBackend) Events() <-chan fsEvent {
+	return b.events
+}
+
+func (b *notifyBackend) Errors() <-chan error {
+	return b.errors
+}
+
+func (b *notifyBackend) Close() error {
+	notify.Stop(b.c)
+	close(b.c)
+	return nil
+}